@@ -0,0 +1,526 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Spencer Kimball (spencer.kimball@gmail.com)
+
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gogoproto "github.com/gogo/protobuf/proto"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+const (
+	// defaultIDAllocMaxRetries bounds how many times a failed KV
+	// increment is retried before allocateBlock gives up.
+	defaultIDAllocMaxRetries = 5
+	// defaultIDAllocRetryBase is the initial backoff between retries;
+	// it doubles on each subsequent attempt, up to defaultIDAllocRetryCap.
+	defaultIDAllocRetryBase = 50 * time.Millisecond
+	// defaultIDAllocRetryCap bounds the backoff between retries.
+	defaultIDAllocRetryCap = 2 * time.Second
+)
+
+// IDAllocator generates unique, monotonically increasing IDs. It is
+// safe for concurrent use by multiple goroutines. Implementations
+// include kvIDAllocator, which is backed by a KV counter, and
+// memIDAllocator, a lightweight in-memory allocator for use in tests
+// and other contexts that don't need IDs to survive a restart.
+type IDAllocator interface {
+	// Allocate returns the next available ID. It blocks until an ID
+	// is available or ctx is done, whichever comes first.
+	Allocate(ctx context.Context) (int64, error)
+	// AllocateN reserves a contiguous range of up to count IDs,
+	// returning the first ID in the range and the number of IDs
+	// actually granted (which may be less than count). It returns
+	// ctx.Err() immediately if ctx is done.
+	AllocateN(ctx context.Context, count uint32) (int64, uint32, error)
+	// Rebase advances the allocator so that calls to Allocate made
+	// after it returns never yield a value below newMin. The underlying
+	// counter, which holds the last ID handed out, is atomically raised
+	// to newMin-1 unless it's already at or past that; IDs already
+	// obtained but not yet handed out are dropped if they're below
+	// newMin.
+	Rebase(newMin int64) error
+	// Stop releases any resources held by the allocator. It is safe
+	// to call Stop more than once.
+	Stop()
+}
+
+// kvIDAllocator is the IDAllocator used in production: IDs are
+// allocated from the contents of idKey, a system key which is
+// incremented via the KV client db. To amortize the cost of the
+// underlying KV increment, IDs are requested in blocks of blockSize
+// and buffered locally, so that only every blockSize'th call to
+// Allocate incurs a round trip to the KV layer. Once the number of
+// buffered IDs drops to lowWater, a block refill is kicked off
+// asynchronously so that later calls to Allocate keep being served
+// from the buffer instead of paying for the KV round trip inline.
+// Use NewIDAllocator to create a kvIDAllocator.
+type kvIDAllocator struct {
+	idKey     engine.Key
+	db        *client.KV
+	minID     int64      // minimum ID to return
+	blockSize int64      // number of IDs allocated per KV increment
+	lowWater  int64      // buffered ID count at which an async refill is triggered
+	ids       chan int64 // buffered, not-yet-allocated IDs
+
+	maxRetries int           // max KV increment retries before giving up
+	retryBase  time.Duration // initial backoff between retries
+	retryCap   time.Duration // backoff ceiling
+
+	mu        sync.Mutex // protects the fields below
+	refilling bool       // true while an async refill is in flight
+	asyncErr  error      // error from the most recent async refill, surfaced on the next Allocate
+	stopped   bool
+	wg        sync.WaitGroup
+}
+
+// NewIDAllocator creates a new KV-backed ID allocator which will
+// allocate IDs in blocks of size blockSize, with a minimum ID value
+// of minID. The allocator refills its buffer once it's down to a
+// quarter of a block and retries a failed KV increment defaultIDAllocMaxRetries
+// times with backoff capped at defaultIDAllocRetryCap; use
+// NewIDAllocatorWithOptions to tune any of these.
+//
+// NewIDAllocator returns the concrete *kvIDAllocator rather than the
+// IDAllocator interface, unlike NewMemIDAllocator: existing white-box
+// tests in this package need direct access to fields like idKey, which
+// the interface doesn't expose. Callers that don't need that can still
+// assign the result to an IDAllocator-typed variable.
+func NewIDAllocator(idKey engine.Key, db *client.KV, minID int64, blockSize int64) (*kvIDAllocator, error) {
+	return NewIDAllocatorWithOptions(idKey, db, minID, blockSize, blockSize/4,
+		defaultIDAllocMaxRetries, defaultIDAllocRetryBase, defaultIDAllocRetryCap)
+}
+
+// NewIDAllocatorWithOptions is like NewIDAllocator but additionally
+// lets the caller configure lowWater (the buffered ID count at or
+// below which an asynchronous block refill is triggered) and the
+// bounded-retry behavior of KV increments: maxRetries is the number of
+// retries attempted before an increment is given up on, and the delay
+// between retries starts at retryBase and doubles up to retryCap.
+func NewIDAllocatorWithOptions(idKey engine.Key, db *client.KV, minID, blockSize, lowWater int64, maxRetries int, retryBase, retryCap time.Duration) (*kvIDAllocator, error) {
+	if minID <= 0 {
+		return nil, util.Errorf("minID must be a positive integer: %d", minID)
+	}
+	if blockSize < 1 {
+		return nil, util.Errorf("blockSize must be a positive integer: %d", blockSize)
+	}
+	if lowWater < 0 || lowWater >= blockSize {
+		return nil, util.Errorf("lowWater must be between 0 and blockSize-1: %d", lowWater)
+	}
+	if maxRetries < 0 {
+		return nil, util.Errorf("maxRetries must not be negative: %d", maxRetries)
+	}
+	if retryBase <= 0 {
+		return nil, util.Errorf("retryBase must be positive: %s", retryBase)
+	}
+	if retryCap < retryBase {
+		return nil, util.Errorf("retryCap must be at least retryBase: %s < %s", retryCap, retryBase)
+	}
+
+	ia := &kvIDAllocator{
+		idKey:     idKey,
+		db:        db,
+		minID:     minID,
+		blockSize: blockSize,
+		lowWater:  lowWater,
+		// The buffer must hold a full block plus whatever's left over
+		// from the previous one at the point a refill is triggered.
+		ids:        make(chan int64, blockSize+lowWater),
+		maxRetries: maxRetries,
+		retryBase:  retryBase,
+		retryCap:   retryCap,
+	}
+	return ia, nil
+}
+
+// Allocate allocates a new ID from the global KV DB. It returns
+// ctx.Err() immediately if ctx is done, whether while waiting on a KV
+// round trip or while waiting for an in-flight low-water refill to
+// land in an empty buffer.
+func (ia *kvIDAllocator) Allocate(ctx context.Context) (int64, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+
+	ia.mu.Lock()
+	defer ia.mu.Unlock()
+	// Wait for an in-flight refill to land rather than start a second,
+	// synchronous one: the two blocks together would overfill the buffer.
+	for len(ia.ids) == 0 && ia.refilling {
+		ia.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			ia.mu.Lock()
+			return 0, ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+		ia.mu.Lock()
+	}
+	switch {
+	case len(ia.ids) == 0:
+		if ia.asyncErr != nil {
+			err := ia.asyncErr
+			ia.asyncErr = nil
+			return 0, err
+		}
+		value, err := ia.allocateBlock(ctx, ia.idKey, ia.db, ia.blockSize)
+		if err != nil {
+			return 0, err
+		}
+		for i := value - ia.blockSize + 1; i <= value; i++ {
+			ia.ids <- i
+		}
+	case int64(len(ia.ids)) <= ia.lowWater:
+		ia.maybeRefillLocked()
+	}
+	// The buffer is non-empty at this point, whichever branch above
+	// ran, and ia.mu is held throughout, so this can't race with
+	// AllocateN's own locked drain of the same channel: without that,
+	// the two could each believe they'd claimed an ID that the other
+	// had just received.
+	return <-ia.ids, nil
+}
+
+// maybeRefillLocked kicks off an asynchronous block refill unless one
+// is already in flight or the allocator has been stopped. ia.mu must
+// be held by the caller. The refill isn't tied to any particular
+// caller's context, so it runs to completion (subject to its own
+// retry budget) even if the Allocate call that triggered it returns
+// first.
+func (ia *kvIDAllocator) maybeRefillLocked() {
+	if ia.refilling || ia.stopped {
+		return
+	}
+	ia.refilling = true
+	// idKey and db are snapshotted here, while ia.mu is held, rather
+	// than read from ia inside the goroutine below: idKey in particular
+	// is mutated directly by white-box tests without holding ia.mu, and
+	// reading it from an unsynchronized goroutine would race.
+	idKey, db := ia.idKey, ia.db
+	ia.wg.Add(1)
+	go func() {
+		defer ia.wg.Done()
+		value, err := ia.allocateBlock(context.Background(), idKey, db, ia.blockSize)
+		ia.mu.Lock()
+		defer ia.mu.Unlock()
+		ia.refilling = false
+		if err != nil {
+			ia.asyncErr = err
+			return
+		}
+		for i := value - ia.blockSize + 1; i <= value; i++ {
+			ia.ids <- i
+		}
+	}()
+}
+
+// Stop waits for any in-flight asynchronous refill to finish and
+// prevents further ones from being started. It is safe to call Stop
+// more than once.
+func (ia *kvIDAllocator) Stop() {
+	ia.mu.Lock()
+	if ia.stopped {
+		ia.mu.Unlock()
+		return
+	}
+	ia.stopped = true
+	ia.mu.Unlock()
+	ia.wg.Wait()
+}
+
+// Rebase atomically advances the counter stored at ia.idKey to
+// max(current, newMin-1) with a single conditional put, retried on a
+// concurrent writer until it wins the CAS rather than by repeatedly
+// incrementing the counter one block at a time. It then waits for any
+// in-flight refill, discards any already-buffered IDs strictly less
+// than newMin and, if that leaves the buffer at or below ia.lowWater,
+// starts a refill, so that the very next Allocate reflects the new
+// floor.
+//
+// This is used for scenarios like restoring a backup or importing
+// pre-assigned range or replica IDs, where the caller knows a lower
+// bound the allocator must exceed.
+func (ia *kvIDAllocator) Rebase(newMin int64) error {
+	for {
+		gr := &proto.GetRequest{RequestHeader: proto.RequestHeader{Key: ia.idKey}}
+		getResp := &proto.GetResponse{}
+		if err := ia.db.Call(proto.Get, gr, getResp); err != nil {
+			return err
+		}
+		var cur int64
+		if getResp.Value != nil {
+			cur = getResp.Value.GetInteger()
+		}
+		// The stored counter holds the last ID already granted (see
+		// allocateBlock), so it must become newMin-1 for the next
+		// Allocate to return exactly newMin.
+		if cur >= newMin-1 {
+			break
+		}
+
+		cpr := &proto.ConditionalPutRequest{
+			RequestHeader: proto.RequestHeader{Key: ia.idKey},
+			Value:         proto.Value{Integer: gogoproto.Int64(newMin - 1)},
+			ExpValue:      getResp.Value,
+		}
+		cpResp := &proto.ConditionalPutResponse{}
+		if err := ia.db.Call(proto.ConditionalPut, cpr, cpResp); err != nil {
+			if _, ok := err.(*proto.ConditionFailedError); ok {
+				// Someone else changed the counter out from under us;
+				// re-read and retry.
+				continue
+			}
+			return err
+		}
+		break
+	}
+
+	ia.mu.Lock()
+	// Let an in-flight refill land first, so that any IDs it obtained
+	// from below the new floor are discarded along with the rest.
+	for ia.refilling {
+		ia.mu.Unlock()
+		time.Sleep(time.Millisecond)
+		ia.mu.Lock()
+	}
+	ia.discardStaleLocked(newMin)
+	ia.asyncErr = nil
+	if int64(len(ia.ids)) <= ia.lowWater {
+		ia.maybeRefillLocked()
+	}
+	ia.mu.Unlock()
+	return nil
+}
+
+// discardStaleLocked drops any buffered IDs strictly less than newMin.
+// ia.mu must be held by the caller.
+func (ia *kvIDAllocator) discardStaleLocked(newMin int64) {
+	kept := make([]int64, 0, len(ia.ids))
+	for {
+		select {
+		case id := <-ia.ids:
+			if id >= newMin {
+				kept = append(kept, id)
+			}
+		default:
+			for _, id := range kept {
+				ia.ids <- id
+			}
+			return
+		}
+	}
+}
+
+// AllocateN reserves a contiguous range of up to count IDs, returning
+// the first ID in the range and the number of IDs actually granted,
+// which is count capped at
+// ia.blockSize; callers that need more than a block's worth of IDs
+// must call AllocateN again for the remainder, mirroring the way
+// Allocate requires repeated calls to drain more than one block.
+//
+// Requests that fit within the currently buffered IDs are served
+// from that buffer, triggering the same low-water async refill as
+// Allocate if the buffer is left at or below ia.lowWater; larger
+// requests, and buffered runs that turn out to span a gap between
+// blocks (those IDs are dropped), go straight to the KV layer for a
+// fresh, contiguous block.
+func (ia *kvIDAllocator) AllocateN(ctx context.Context, count uint32) (int64, uint32, error) {
+	select {
+	case <-ctx.Done():
+		return 0, 0, ctx.Err()
+	default:
+	}
+
+	if count == 0 {
+		return 0, 0, util.Errorf("count must be a positive integer: %d", count)
+	}
+	n := int64(count)
+	if n > ia.blockSize {
+		n = ia.blockSize
+	}
+
+	ia.mu.Lock()
+	if n <= int64(len(ia.ids)) {
+		start := <-ia.ids
+		contiguous := true
+		for i := int64(1); i < n; i++ {
+			if <-ia.ids != start+i {
+				contiguous = false
+			}
+		}
+		if int64(len(ia.ids)) <= ia.lowWater {
+			ia.maybeRefillLocked()
+		}
+		if contiguous {
+			ia.mu.Unlock()
+			return start, uint32(n), nil
+		}
+	}
+	value, err := ia.allocateBlock(ctx, ia.idKey, ia.db, n)
+	ia.mu.Unlock()
+	if err != nil {
+		return 0, 0, err
+	}
+	return value - n + 1, uint32(n), nil
+}
+
+// allocateBlock increments the counter stored at ia.idKey by incr and
+// returns the new value. If the first ID of the incremented range
+// (the counter's prior value plus one) falls below ia.minID (e.g. because it was never initialized, or
+// was seeded with a stale or negative value), a second increment is
+// issued to jump the counter straight past ia.minID so that the
+// range handed back still spans exactly incr IDs, all >= ia.minID.
+func (ia *kvIDAllocator) allocateBlock(ctx context.Context, idKey engine.Key, db *client.KV, incr int64) (int64, error) {
+	value, err := ia.incrementWithRetry(ctx, idKey, db, incr)
+	if err != nil {
+		return 0, err
+	}
+	if value-incr+1 < ia.minID {
+		value, err = ia.incrementWithRetry(ctx, idKey, db, ia.minID-(value-incr+1))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return value, nil
+}
+
+// incrementWithRetry issues a single KV increment against key,
+// retrying with exponential backoff (starting at ia.retryBase and
+// capped at ia.retryCap) up to ia.maxRetries times if the increment
+// fails. ctx.Done() aborts the wait for an increment or a backoff
+// immediately, so a shutting-down node doesn't block on a stuck KV
+// operation (an abandoned increment may still consume its IDs); once the underlying
+// store heals, the very next call succeeds without any outside
+// intervention.
+func (ia *kvIDAllocator) incrementWithRetry(ctx context.Context, key engine.Key, db *client.KV, incr int64) (int64, error) {
+	ir := &proto.IncrementRequest{
+		RequestHeader: proto.RequestHeader{Key: key},
+		Increment:     incr,
+	}
+	backoff := ia.retryBase
+	var lastErr error
+	for attempt := 0; attempt <= ia.maxRetries; attempt++ {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		default:
+		}
+
+		resp := &proto.IncrementResponse{}
+		errCh := make(chan error, 1)
+		go func() { errCh <- db.Call(proto.Increment, ir, resp) }()
+		var err error
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case err = <-errCh:
+		}
+		if err == nil {
+			return resp.NewValue, nil
+		}
+		lastErr = err
+
+		if attempt == ia.maxRetries {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > ia.retryCap {
+			backoff = ia.retryCap
+		}
+	}
+	return 0, lastErr
+}
+
+// memIDAllocator is an in-memory IDAllocator which hands out
+// monotonically increasing IDs starting at minID without touching
+// the KV layer. It's useful for test helpers and in-memory stores
+// that need unique IDs but don't need them to survive a restart,
+// analogous to the in-memory autoid allocator found in other
+// distributed SQL engines.
+type memIDAllocator struct {
+	counter int64 // atomically incremented; holds the last ID allocated
+}
+
+// NewMemIDAllocator creates an in-memory IDAllocator seeded so the
+// first call to Allocate returns minID. It returns the IDAllocator
+// interface rather than the concrete *memIDAllocator: unlike
+// kvIDAllocator's constructors, nothing needs to reach past the
+// interface at any field memIDAllocator exposes.
+func NewMemIDAllocator(minID int64) (IDAllocator, error) {
+	if minID <= 0 {
+		return nil, util.Errorf("minID must be a positive integer: %d", minID)
+	}
+	return &memIDAllocator{counter: minID - 1}, nil
+}
+
+// Allocate returns the next available ID.
+func (ia *memIDAllocator) Allocate(ctx context.Context) (int64, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+	return atomic.AddInt64(&ia.counter, 1), nil
+}
+
+// AllocateN reserves a contiguous range of count IDs, returning the
+// first ID in the range.
+func (ia *memIDAllocator) AllocateN(ctx context.Context, count uint32) (int64, uint32, error) {
+	select {
+	case <-ctx.Done():
+		return 0, 0, ctx.Err()
+	default:
+	}
+	if count == 0 {
+		return 0, 0, util.Errorf("count must be a positive integer: %d", count)
+	}
+	end := atomic.AddInt64(&ia.counter, int64(count))
+	return end - int64(count) + 1, count, nil
+}
+
+// Rebase atomically advances the counter, which holds the last ID
+// allocated, to max(current, newMin-1).
+func (ia *memIDAllocator) Rebase(newMin int64) error {
+	for {
+		cur := atomic.LoadInt64(&ia.counter)
+		if cur >= newMin-1 {
+			return nil
+		}
+		if atomic.CompareAndSwapInt64(&ia.counter, cur, newMin-1) {
+			return nil
+		}
+	}
+}
+
+// Stop is a no-op for memIDAllocator; it exists to satisfy the
+// IDAllocator interface.
+func (ia *memIDAllocator) Stop() {}
@@ -19,7 +19,11 @@ package storage
 
 import (
 	"sort"
+	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/storage/engine"
 )
@@ -41,7 +45,7 @@ func TestIDAllocator(t *testing.T) {
 	for i := 0; i < 10; i++ {
 		go func() {
 			for j := 0; j < 10; j++ {
-				id, _ := idAlloc.Allocate()
+				id, _ := idAlloc.Allocate(context.Background())
 				allocd <- int(id)
 			}
 		}()
@@ -86,7 +90,7 @@ func TestIDAllocatorNegativeValue(t *testing.T) {
 	if err != nil {
 		t.Errorf("failed to create IDAllocator: %v", err)
 	}
-	value, err := idAlloc.Allocate()
+	value, err := idAlloc.Allocate(context.Background())
 	if err != nil {
 		t.Errorf("failed to allocate id: %v", err)
 	}
@@ -119,7 +123,7 @@ func TestAllocateErrorHandling(t *testing.T) {
 		t.Errorf("failed to create IDAllocator: %v", err)
 	}
 
-	_, err = idAlloc.Allocate()
+	_, err = idAlloc.Allocate(context.Background())
 	if err == nil {
 		t.Errorf("expect to return error, but got nil")
 	}
@@ -137,8 +141,9 @@ func TestAllocateErrorWithExistingIDAndRecovery(t *testing.T) {
 	if err != nil {
 		t.Errorf("failed to create IDAllocator: %v", err)
 	}
+	defer idAlloc.Stop()
 
-	id, err := idAlloc.Allocate()
+	id, err := idAlloc.Allocate(context.Background())
 	if err != nil {
 		t.Errorf("failed to allocate id: %v", err)
 	}
@@ -149,12 +154,11 @@ func TestAllocateErrorWithExistingIDAndRecovery(t *testing.T) {
 	// set nil idKey to trigger KV DB increment error
 	idAlloc.idKey = nil
 
-	// even allocateBlock will return error, but Allocate() will return the
-	// existing ID. Already got one ID from channel, and one allocationTrigger
-	// in the middle, so there will be only 8 IDs left in the channel, and start
-	// from 3
-	for i := 0; i < 8; i++ {
-		id, err := idAlloc.Allocate()
+	// The first block spans 2..11 (10 IDs); one was already consumed
+	// above, leaving exactly 9 buffered. Drain all of them so the
+	// buffer is empty before we start asserting errors below.
+	for i := 0; i < 9; i++ {
+		id, err := idAlloc.Allocate(context.Background())
 		if err != nil {
 			t.Errorf("failed to allocate id: %v", err)
 		}
@@ -165,7 +169,7 @@ func TestAllocateErrorWithExistingIDAndRecovery(t *testing.T) {
 
 	// the subsequent Allocate() will return error
 	for i := 0; i < 10; i++ {
-		_, err := idAlloc.Allocate()
+		_, err := idAlloc.Allocate(context.Background())
 		if err == nil {
 			t.Errorf("expect to return error, but got nil")
 		}
@@ -174,8 +178,8 @@ func TestAllocateErrorWithExistingIDAndRecovery(t *testing.T) {
 	// then set correct idKey to recover from error, should be able to allocate
 	// ID again
 	idAlloc.idKey = engine.KeyRaftIDGenerator
-	for i := 11; i < 50; i++ { //previous existing MaxID is 10, so start from 11
-		id, err := idAlloc.Allocate()
+	for i := 12; i < 50; i++ { // previous existing MaxID is 11, so start from 12
+		id, err := idAlloc.Allocate(context.Background())
 		if err != nil {
 			t.Errorf("failed to allocate id: %v", err)
 		}
@@ -184,3 +188,257 @@ func TestAllocateErrorWithExistingIDAndRecovery(t *testing.T) {
 		}
 	}
 }
+
+// TestIDAllocatorLowWaterRefill verifies that once the buffered ID
+// count drops to the low-water mark, a block refill happens in the
+// background, so a single caller allocating many IDs in a tight loop
+// doesn't see its slowest calls cluster around block boundaries: the
+// 99th-percentile latency should stay close to the median rather than
+// spiking whenever the buffer would otherwise run dry.
+func TestIDAllocatorLowWaterRefill(t *testing.T) {
+	store, _ := createTestStore(t)
+	const blockSize = 100
+	idAlloc, err := NewIDAllocator(engine.KeyRaftIDGenerator, store.db, 2, blockSize)
+	if err != nil {
+		t.Fatalf("failed to create IDAllocator: %v", err)
+	}
+	defer idAlloc.Stop()
+
+	const numAllocs = 1000
+	latencies := make([]time.Duration, numAllocs)
+	for i := 0; i < numAllocs; i++ {
+		start := time.Now()
+		if _, err := idAlloc.Allocate(context.Background()); err != nil {
+			t.Fatalf("failed to allocate id: %v", err)
+		}
+		latencies[i] = time.Since(start)
+	}
+
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	median := sorted[len(sorted)/2]
+	p99 := sorted[len(sorted)*99/100]
+
+	// The background refill should keep the buffer from ever running
+	// fully dry under this load, so p99 shouldn't be wildly out of
+	// line with the median. The multiplier is generous to keep this
+	// robust under test-machine jitter; it only needs to catch a
+	// regression back to synchronous, block-boundary-aligned refills.
+	if median > 0 && p99 > 50*median {
+		t.Errorf("p99 allocate latency (%s) is too far from median (%s); low-water refill may not be keeping up", p99, median)
+	}
+}
+
+// TestAllocateWithCancelledContext verifies that Allocate returns the
+// context's error immediately when the context is already done,
+// rather than blocking on a KV round trip or waiting for a buffered
+// ID that will never come.
+func TestAllocateWithCancelledContext(t *testing.T) {
+	store, _ := createTestStore(t)
+	idAlloc, err := NewIDAllocator(engine.KeyRaftIDGenerator, store.db, 2, 10)
+	if err != nil {
+		t.Fatalf("failed to create IDAllocator: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := idAlloc.Allocate(ctx); err != ctx.Err() {
+		t.Errorf("expected Allocate to return the context's error; got %v", err)
+	}
+}
+
+// TestIDAllocatorImplementations runs the same sequence of Allocate,
+// AllocateN and Rebase calls against both IDAllocator implementations,
+// so that behavior expected to be interchangeable between them (e.g.
+// what Rebase leaves the next Allocate returning) is actually checked
+// against both rather than just the one under test.
+func TestIDAllocatorImplementations(t *testing.T) {
+	testCases := []struct {
+		name     string
+		newAlloc func(t *testing.T) IDAllocator
+	}{
+		{"kv", func(t *testing.T) IDAllocator {
+			store, _ := createTestStore(t)
+			idAlloc, err := NewIDAllocator(engine.KeyRaftIDGenerator, store.db, 2, 10)
+			if err != nil {
+				t.Fatalf("failed to create IDAllocator: %v", err)
+			}
+			return idAlloc
+		}},
+		{"mem", func(t *testing.T) IDAllocator {
+			idAlloc, err := NewMemIDAllocator(2)
+			if err != nil {
+				t.Fatalf("failed to create IDAllocator: %v", err)
+			}
+			return idAlloc
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			idAlloc := tc.newAlloc(t)
+			defer idAlloc.Stop()
+
+			id, err := idAlloc.Allocate(context.Background())
+			if err != nil {
+				t.Fatalf("failed to allocate id: %v", err)
+			}
+			if id != 2 {
+				t.Errorf("expected first ID to be 2; got %d", id)
+			}
+
+			start, n, err := idAlloc.AllocateN(context.Background(), 3)
+			if err != nil {
+				t.Fatalf("failed to allocate ids: %v", err)
+			}
+			if start != 3 || n != 3 {
+				t.Errorf("expected AllocateN(3) to grant (3, 3); got (%d, %d)", start, n)
+			}
+
+			// 2 through 5 have been consumed; rebasing to 5 is a no-op,
+			// so the next ID should be unaffected: 6.
+			if err := idAlloc.Rebase(5); err != nil {
+				t.Fatalf("failed to rebase: %v", err)
+			}
+			if id, err := idAlloc.Allocate(context.Background()); err != nil {
+				t.Fatalf("failed to allocate id: %v", err)
+			} else if id != 6 {
+				t.Errorf("expected next ID to be 6 after a no-op rebase; got %d", id)
+			}
+
+			// Rebase above the current counter fast-forwards so the
+			// next ID is at least newMin.
+			if err := idAlloc.Rebase(1000); err != nil {
+				t.Fatalf("failed to rebase: %v", err)
+			}
+			if id, err := idAlloc.Allocate(context.Background()); err != nil {
+				t.Fatalf("failed to allocate id: %v", err)
+			} else if id < 1000 {
+				t.Errorf("expected next ID to be >= 1000 after rebase; got %d", id)
+			}
+		})
+	}
+}
+
+// TestIDAllocatorRebaseBelowCurrent verifies that Rebase is a no-op
+// when newMin is at or below the counter's current value.
+func TestIDAllocatorRebaseBelowCurrent(t *testing.T) {
+	store, _ := createTestStore(t)
+	idAlloc, err := NewIDAllocator(engine.KeyRaftIDGenerator, store.db, 2, 10)
+	if err != nil {
+		t.Fatalf("failed to create IDAllocator: %v", err)
+	}
+	defer idAlloc.Stop()
+
+	id, err := idAlloc.Allocate(context.Background())
+	if err != nil {
+		t.Fatalf("failed to allocate id: %v", err)
+	}
+	if id != 2 {
+		t.Fatalf("expected first ID to be 2; got %d", id)
+	}
+
+	if err := idAlloc.Rebase(2); err != nil {
+		t.Fatalf("failed to rebase: %v", err)
+	}
+
+	// The next ID should be unaffected by the no-op rebase.
+	id, err = idAlloc.Allocate(context.Background())
+	if err != nil {
+		t.Fatalf("failed to allocate id: %v", err)
+	}
+	if id != 3 {
+		t.Errorf("expected next ID to be 3 after a no-op rebase; got %d", id)
+	}
+}
+
+// TestIDAllocatorRebaseAboveCurrent verifies that Rebase fast-forwards
+// the allocator so the next ID is at least newMin, discarding any
+// already-buffered IDs that fall below it.
+func TestIDAllocatorRebaseAboveCurrent(t *testing.T) {
+	store, _ := createTestStore(t)
+	idAlloc, err := NewIDAllocator(engine.KeyRaftIDGenerator, store.db, 2, 10)
+	if err != nil {
+		t.Fatalf("failed to create IDAllocator: %v", err)
+	}
+	defer idAlloc.Stop()
+
+	id, err := idAlloc.Allocate(context.Background())
+	if err != nil {
+		t.Fatalf("failed to allocate id: %v", err)
+	}
+	if id != 2 {
+		t.Fatalf("expected first ID to be 2; got %d", id)
+	}
+
+	if err := idAlloc.Rebase(1000); err != nil {
+		t.Fatalf("failed to rebase: %v", err)
+	}
+
+	id, err = idAlloc.Allocate(context.Background())
+	if err != nil {
+		t.Fatalf("failed to allocate id: %v", err)
+	}
+	if id < 1000 {
+		t.Errorf("expected next ID to be >= 1000 after rebase; got %d", id)
+	}
+}
+
+// TestIDAllocatorRebaseConcurrentWithAllocate exercises Rebase racing
+// against concurrent Allocate calls: every ID produced must be unique,
+// and at least one of them must be at or above newMin.
+func TestIDAllocatorRebaseConcurrentWithAllocate(t *testing.T) {
+	store, _ := createTestStore(t)
+	idAlloc, err := NewIDAllocator(engine.KeyRaftIDGenerator, store.db, 2, 10)
+	if err != nil {
+		t.Fatalf("failed to create IDAllocator: %v", err)
+	}
+	defer idAlloc.Stop()
+
+	const newMin = 10000
+	var wg sync.WaitGroup
+	ids := make(chan int64, 200)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				id, err := idAlloc.Allocate(context.Background())
+				if err != nil {
+					t.Errorf("failed to allocate id: %v", err)
+					return
+				}
+				ids <- id
+			}
+		}()
+	}
+
+	if err := idAlloc.Rebase(newMin); err != nil {
+		t.Errorf("failed to rebase: %v", err)
+	}
+
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[int64]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Errorf("ID %d allocated more than once", id)
+		}
+		seen[id] = true
+	}
+
+	// Allocations that land after the rebase takes effect draw from
+	// the new floor, so at least one ID must be >= newMin.
+	var sawRebased bool
+	for id := range seen {
+		if id >= newMin {
+			sawRebased = true
+			break
+		}
+	}
+	if !sawRebased {
+		t.Errorf("expected at least one allocated ID >= %d after rebase", newMin)
+	}
+}